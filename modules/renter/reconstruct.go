@@ -0,0 +1,123 @@
+package renter
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/NebulousLabs/Sia/modules/renter/repairer"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// hostPieceFetcher adapts the renter's worker pool into the
+// repairer.PieceFetcher interface expected by the SegmentRepairer.
+type hostPieceFetcher struct {
+	r *Renter
+}
+
+// FetchPiece downloads a single piece of a chunk from the host backing
+// contract, for use when reconstructing a chunk whose local source file is
+// unavailable.
+func (hpf *hostPieceFetcher) FetchPiece(contract types.FileContractID, chunkIndex, pieceIndex uint64) ([]byte, error) {
+	id := hpf.r.mu.RLock()
+	worker, exists := hpf.r.workerPool[contract]
+	hpf.r.mu.RUnlock(id)
+	if !exists {
+		return nil, errors.New("no worker available for contract")
+	}
+	return worker.downloadPiece(chunkIndex, pieceIndex)
+}
+
+// managedReconstructChunk is called when a chunk's local source file is no
+// longer available. It gathers every surviving piece of the chunk across
+// the file's contracts and asks the renter's SegmentRepairer to download
+// enough of them to reconstruct the original chunk data, so that repair can
+// proceed exactly as if the local copy were still present.
+func (r *Renter) managedReconstructChunk(file *file, chunkIndex uint64) ([]byte, error) {
+	if r.repairer == nil {
+		return nil, errors.New("no segment repairer available")
+	}
+
+	var sources []repairer.PieceSource
+	for _, contract := range file.contracts {
+		for _, piece := range contract.Pieces {
+			if piece.Chunk != chunkIndex {
+				continue
+			}
+			// Skip pieces the scrub worker has already found missing from
+			// their host, the same as addFileToRepairMatrix does, so a
+			// known-bad source doesn't burn one of the tolerated retries.
+			if piece.Unavailable {
+				continue
+			}
+			sources = append(sources, repairer.PieceSource{
+				Contract: contract.ID,
+				Piece:    piece.Piece,
+			})
+		}
+	}
+
+	return r.repairer.Recover(file.masterKey, chunkIndex, file.erasureCode, file.chunkSize(), sources)
+}
+
+// RepairerMetrics is the externally-visible view of the renter's
+// SegmentRepairer counters, returned by Renter.RepairerMetrics so that
+// operators can distinguish repairs served from a local source file from
+// ones that required downloading from hosts.
+type RepairerMetrics struct {
+	ReconstructionsTotal uint64
+	BytesDownloaded      uint64
+}
+
+// RepairerMetrics returns the renter's cumulative chunk-reconstruction
+// counters. It returns the zero value if no SegmentRepairer is configured.
+func (r *Renter) RepairerMetrics() RepairerMetrics {
+	if r.repairer == nil {
+		return RepairerMetrics{}
+	}
+	reconstructionsTotal, bytesDownloaded := r.repairer.Metrics()
+	return RepairerMetrics{
+		ReconstructionsTotal: reconstructionsTotal,
+		BytesDownloaded:      bytesDownloaded,
+	}
+}
+
+// managedEncodeChunk reads a chunk from its local source file - or, if that
+// file is no longer available, reconstructs it from surviving pieces on
+// hosts - and returns it erasure-coded and encrypted into per-piece data
+// ready to hand off to workers. reconstructed reports whether the local
+// source file was missing and the chunk had to be rebuilt from hosts.
+func (r *Renter) managedEncodeChunk(file *file, repairPath string, chunkIndex uint64) (pieces [][]byte, reconstructed bool, err error) {
+	fHandle, err := os.Open(repairPath)
+	var chunk []byte
+	if err != nil {
+		// The local source file is gone. Fall back to reconstructing the
+		// chunk from the pieces that still exist on hosts, rather than
+		// giving up on repairing it.
+		reconstructed = true
+		chunk, err = r.managedReconstructChunk(file, chunkIndex)
+		if err != nil {
+			return nil, reconstructed, err
+		}
+	} else {
+		defer fHandle.Close()
+		chunk = make([]byte, file.chunkSize())
+		_, err = fHandle.ReadAt(chunk, int64(chunkIndex*file.chunkSize()))
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, reconstructed, err
+		}
+	}
+
+	pieces, err = file.erasureCode.Encode(chunk)
+	if err != nil {
+		return nil, reconstructed, err
+	}
+	for i := range pieces {
+		key := deriveKey(file.masterKey, chunkIndex, uint64(i))
+		pieces[i], err = key.EncryptBytes(pieces[i])
+		if err != nil {
+			return nil, reconstructed, err
+		}
+	}
+	return pieces, reconstructed, nil
+}
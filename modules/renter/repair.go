@@ -1,8 +1,7 @@
 package renter
 
 import (
-	"io"
-	"os"
+	"container/heap"
 	"time"
 
 	"github.com/NebulousLabs/Sia/types"
@@ -26,8 +25,8 @@ type (
 )
 
 // addFileToRepairMatrix will take a file and add each of the incomplete chunks
-// to the repair matrix.
-func addFileToRepairMatrix(file *file, availableWorkers map[types.FileContractID]struct{}, repairMatrix map[chunkID]*chunkGaps, gapCounts map[int]int) {
+// to the repair queue.
+func addFileToRepairMatrix(file *file, availableWorkers map[types.FileContractID]struct{}, repairQueue *chunkPriorityQueue, gapCounts map[int]int) {
 	// Flatten availableWorkers into a list of contracts.
 	contracts := make([]types.FileContractID, 0)
 	for contract := range availableWorkers {
@@ -51,19 +50,23 @@ func addFileToRepairMatrix(file *file, availableWorkers map[types.FileContractID
 		for _, piece := range contract.Pieces {
 			utilizedContracts[piece.Chunk] = append(utilizedContracts[piece.Chunk], contract.ID)
 
-			// Only mark the piece as available if the piece can be recovered.
-			//
-			// TODO: Add an 'unavailable' flag to the piece that gets set to
-			// true if the host loses the piece, and only add the piece to the
-			// 'completedPieces' set if !unavailable.
-			pieceMap[piece.Chunk] = append(pieceMap[piece.Chunk], piece.Piece)
+			// Only mark the piece as available if the piece can be
+			// recovered. Pieces that the scrub worker has found to be
+			// missing from the host are skipped, so that silent loss on
+			// the host side causes the repair matrix to correctly flag
+			// the chunk as needing work instead of believing it is still
+			// fully redundant.
+			if piece.Unavailable {
+				continue
+			}
+			completedPieces[piece.Chunk] = append(completedPieces[piece.Chunk], piece.Piece)
 		}
 	}
 
 	// Iterate through each chunk and, if there are gaps, add the inverse
 	// to the repair matrix.
 	for i := uint64(0); i < chunkCount; i++ {
-		if len(pieceMap[i]) < file.erasureCode.NumPieces() {
+		if len(completedPieces[i]) < file.erasureCode.NumPieces() {
 			// Find the gaps in the pieces and contracts.
 			potentialPieceGaps := make([]bool, file.erasureCode.NumPieces())
 			potentialContractGaps := make(map[types.FileContractID]struct{})
@@ -74,10 +77,10 @@ func addFileToRepairMatrix(file *file, availableWorkers map[types.FileContractID
 			// Delete every available piece from the potential piece gaps,
 			// and every utilized contract form the potential contract
 			// gaps.
-			for _, piece := range pieceMap[i] {
+			for _, piece := range completedPieces[i] {
 				potentialPieceGaps[piece] = true
 			}
-			for _, fcid := range contractMap[i] {
+			for _, fcid := range utilizedContracts[i] {
 				delete(potentialContractGaps, fcid)
 			}
 
@@ -96,9 +99,9 @@ func addFileToRepairMatrix(file *file, availableWorkers map[types.FileContractID
 			// blocking-related decisions easier.
 			gapCounts[gaps.numGaps()]++
 
-			// Add the chunk to the repair matrix.
+			// Add the chunk to the repair queue.
 			cid := chunkID{i, file.name}
-			repairMatrix[cid] = &gaps
+			repairQueue.push(cid, &gaps)
 		}
 	}
 }
@@ -111,21 +114,23 @@ func (cg *chunkGaps) numGaps() int {
 	return len(cg.pieces)
 }
 
-func (r *Renter) createRepairMatrix(availableWorkers map[types.FileContractID]struct{}) (map[chunkID]*chunkGaps, map[int]int) {
-	repairMatrix := make(map[chunkID]*chunkGaps)
+func (r *Renter) createRepairMatrix(availableWorkers map[types.FileContractID]struct{}) (*chunkPriorityQueue, map[int]int) {
+	repairQueue := &chunkPriorityQueue{}
+	heap.Init(repairQueue)
 	gapCounts := make(map[int]int)
 
-	// Add all of the files to the repair matrix.
+	// Add all of the files to the repair queue.
 	for _, file := range r.files {
 		_, exists := r.tracking[file.name]
 		if !exists {
 			continue
 		}
 		file.mu.Lock()
-		addFileToRepairMatrix(file, availableWorkers, repairMatrix, gapCounts)
+		addFileToRepairMatrix(file, availableWorkers, repairQueue, gapCounts)
 		file.mu.Unlock()
 	}
-	return repairMatrix, gapCounts
+	r.repairQueueStore.updateFromMatrix(repairQueue)
+	return repairQueue, gapCounts
 }
 
 func (r *Renter) managedRepairIteration() {
@@ -133,20 +138,20 @@ func (r *Renter) managedRepairIteration() {
 	// uploading.
 	availableWorkers := make(map[types.FileContractID]struct{})
 	id := r.mu.RLock()
-	for id, worker := range r.workerPool {
-		// Ignore workers that have had an upload failure in the past two
-		// hours.
-		if worker.recentUploadFailure.Add(time.Hour).Before(time.Now()) {
+	for id := range r.workerPool {
+		// Ignore workers whose host is still within its backoff window
+		// following a recent upload failure.
+		if r.workerErrors.available(id) {
 			availableWorkers[id] = struct{}{}
 		}
 	}
 	r.mu.RUnlock(id)
 
-	// Create the repair matrix. The repair matrix is a set of chunks,
-	// linked from chunk id to the set of hosts that do not have that
+	// Create the repair queue. The repair queue is a priority queue of
+	// chunks, ordered by how many hosts and pieces are missing for that
 	// chunk.
 	id = r.mu.Lock()
-	repairMatrix, gapCounts := r.createRepairMatrix(availableWorkers)
+	repairQueue, gapCounts := r.createRepairMatrix(availableWorkers)
 	r.mu.Unlock(id)
 
 	// Determine the maximum number of gaps of any chunk in the repair matrix.
@@ -180,6 +185,16 @@ func (r *Renter) managedRepairIteration() {
 		activeWorkers[k] = v
 	}
 	var retiredWorkers []types.FileContractID
+	// quota is reset every time the inner pop loop below has scanned as
+	// many chunks as were in the queue when quota was last created, i.e.
+	// once per full pass over the repair queue. Without this reset, a
+	// quota created at the start of managedRepairIteration would cap a
+	// file to repairFileQuota chunks for the entire up-to-one-hour
+	// session, even long after its earlier chunks finished uploading and
+	// freed up workers for it.
+	quota := newFileQuota(repairFileQuota)
+	quotaPassRemaining := repairQueue.Len()
+	activeChunks := make(map[chunkID]*sharedChunkState)
 	resultChan := make(chan finishedUpload)
 	for {
 		// Break if tg.Stop() has been called, to facilitate quick shutdown.
@@ -202,137 +217,167 @@ func (r *Renter) managedRepairIteration() {
 			break
 		}
 
-		// Iterate through the chunks until a candidate chunk is found.
-		for chunkID, chunkGaps := range repairMatrix {
-			// Figure out how many pieces in this chunk could be repaired
-			// by the current availableWorkers.
-			var usefulWorkers []types.FileContractID
+		// Pop chunks from the priority queue, most-degraded first, until
+		// one is found that the current availableWorkers can make
+		// progress on and that is still within its file's quota for this
+		// repair session. A retired worker's contract id is pruned from
+		// every queued chunk as soon as the worker is retired (see the
+		// result loop below), and every popped chunk is pruned again
+		// before it is either chosen or requeued, so - unlike the old
+		// flat-map scan - stale contracts can no longer linger on a chunk
+		// that simply isn't visited this pass.
+		var chosen *chunkQueueEntry
+		var usefulWorkers []types.FileContractID
+		var requeue []*chunkQueueEntry
+		for repairQueue.Len() > 0 {
+			entry := heap.Pop(repairQueue).(*chunkQueueEntry)
+			if quotaPassRemaining <= 0 {
+				// A full pass over the queue has been scanned since quota
+				// was last created; give every file a fresh quota for the
+				// next pass instead of leaving files starved for the rest
+				// of the repair session.
+				quota = newFileQuota(repairFileQuota)
+				quotaPassRemaining = repairQueue.Len() + 1
+			}
+			quotaPassRemaining--
+			chunkGaps := entry.gaps
+			oldNumGaps := chunkGaps.numGaps()
+
+			for _, retire := range retiredWorkers {
+				for i := range chunkGaps.contracts {
+					if chunkGaps.contracts[i] == retire {
+						chunkGaps.contracts = append(chunkGaps.contracts[:i], chunkGaps.contracts[i+1:]...)
+						break
+					}
+				}
+			}
+			if newNumGaps := chunkGaps.numGaps(); newNumGaps != oldNumGaps {
+				gapCounts[oldNumGaps]--
+				gapCounts[newNumGaps]++
+			}
+
+			var useful []types.FileContractID
 			for worker := range availableWorkers {
 				for _, contract := range chunkGaps.contracts {
 					if worker == contract {
-						usefulWorkers = append(usefulWorkers, worker)
+						useful = append(useful, worker)
 					}
 				}
 			}
 
-			if maxGaps >= 4 && len(usefulWorkers) < 4 {
-				// These workers in particular are not useful for this
-				// chunk - need a different or broader set of workers.
-				// Update the gapCount for this chunk - retired workers may
-				// have altered the number.
-
-				// Remove the contract ids of any workers that have
-				// retired.
-				for _, retire := range retiredWorkers {
-					for i := range chunkGaps.contracts {
-						if chunkGaps.contracts[i] == retire {
-							chunkGaps.contracts = append(chunkGaps.contracts[:i], chunkGaps.contracts[i+1:]...)
-							break
-						}
-					}
-				}
-				// Update the gap counts if they have been affected in any
-				// way.
-				if len(chunkGaps.contracts) < len(chunkGaps.pieces) && len(chunkGaps.contracts) < chunkGaps.numGaps() {
-					oldNumGaps := chunkGaps.numGaps()
-					chunkGaps.numGaps = len(chunkGaps.contracts)
-					gapCounts[oldNumGaps]--
-					gapCounts[chunkGaps.numGaps()]++
-				}
+			if (maxGaps >= 4 && len(useful) < 4) || !quota.allow(entry.id.filename) {
+				// Either these workers aren't useful for this chunk, or
+				// its file has already had its fair share of workers this
+				// pass - requeue it and keep looking.
+				requeue = append(requeue, entry)
 				continue
 			}
 
-			// Parse the filename and chunk index from the repair
-			// matrix key.
-			chunkIndex := chunkID.chunkIndex
-			filename := chunkID.filename
+			chosen = entry
+			usefulWorkers = useful
+			break
+		}
+		for _, entry := range requeue {
+			heap.Push(repairQueue, entry)
+		}
+
+		if chosen != nil {
+			chunkIndex := chosen.id.chunkIndex
+			filename := chosen.id.filename
+			chunkGaps := chosen.gaps
+
 			id := r.mu.RLock()
 			file, exists := r.files[filename]
 			r.mu.RUnlock(id)
 			if !exists {
 				// TODO: Should pull this chunk out of the repair
-				// matrix. The other errors in this block should do the
-				// same.
+				// queue instead of requeuing it. The other errors in
+				// this block should do the same.
+				heap.Push(repairQueue, chosen)
 				continue
 			}
 
-			// Grab the chunk and code it into its separate pieces.
-			id = r.mu.RLock()
-			meta, exists := r.tracking[filename]
-			r.mu.RUnlock(id)
-			if !exists {
-				continue
-			}
-			fHandle, err := os.Open(meta.RepairPath)
-			if err != nil {
-				// TODO: Perform a download-and-repair. Though, this
-				// may block other uploads that are in progress. Not
-				// sure how to do this cleanly in the background?
-				//
-				// TODO: Manage err
-				continue
-			}
-			defer fHandle.Close()
-			chunk := make([]byte, file.chunkSize())
-			_, err = fHandle.ReadAt(chunk, int64(chunkIndex*file.chunkSize()))
-			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-				// TODO: Manage this error.
-				continue
-			}
-			pieces, err := file.erasureCode.Encode(chunk)
-			if err != nil {
-				// TODO: Manage this error.
-				continue
-			}
-			// encrypt pieces
-			for i := range pieces {
-				key := deriveKey(file.masterKey, chunkIndex, uint64(i))
-				pieces[i], err = key.EncryptBytes(pieces[i])
+			// Register a sharedChunkState for the chunk the first time it
+			// is chosen, so that subsequent iterations reuse the already
+			// decoded and encrypted pieces instead of re-reading and
+			// re-encoding the chunk every time a worker becomes free.
+			state, registered := activeChunks[chosen.id]
+			if !registered {
+				id = r.mu.RLock()
+				meta, exists := r.tracking[filename]
+				r.mu.RUnlock(id)
+				if !exists {
+					heap.Push(repairQueue, chosen)
+					continue
+				}
+				pieces, reconstructed, err := r.managedEncodeChunk(file, meta.RepairPath, chunkIndex)
 				if err != nil {
 					// TODO: Manage this error.
+					heap.Push(repairQueue, chosen)
 					continue
 				}
+				state = newSharedChunkState(chosen.id, chunkGaps, pieces)
+				activeChunks[chosen.id] = state
+				r.repairQueueStore.recordAttempt(chosen.id, reconstructed)
 			}
 
-			// Give each piece to a worker, updating the chunkGaps and
-			// availableWorkers along the way.
-			var i int
-			for i = 0; i < len(usefulWorkers) && i < len(chunkGaps.pieces); i++ {
+			// Let every useful worker claim a piece of the chunk and
+			// upload it, updating chunkGaps and availableWorkers along
+			// the way. Because the pieces live in the sharedChunkState
+			// rather than being handed out all at once, a slow upload to
+			// one host no longer blocks a fast upload of the remaining
+			// pieces to others.
+			oldNumGaps := chunkGaps.numGaps()
+			for _, worker := range usefulWorkers {
+				pieceIndex, data, ok := state.claimNextPiece()
+				if !ok {
+					break
+				}
+
 				uw := uploadWork{
 					chunkIndex: chunkIndex,
-					data:       pieces[chunkGaps.pieces[i]],
+					data:       data,
 					file:       file,
-					pieceIndex: chunkGaps.pieces[i],
+					pieceIndex: pieceIndex,
 
 					resultChan: resultChan,
 				}
-				worker := r.workerPool[usefulWorkers[i]]
+				w := r.workerPool[worker]
 				select {
-				case worker.uploadChan <- uw:
+				case w.uploadChan <- uw:
 				case <-r.tg.StopChan():
 					return
 				}
 
-				delete(availableWorkers, usefulWorkers[i])
+				delete(availableWorkers, worker)
 				for j := 0; j < len(chunkGaps.contracts); j++ {
-					if chunkGaps.contracts[j] == usefulWorkers[i] {
+					if chunkGaps.contracts[j] == worker {
 						chunkGaps.contracts = append(chunkGaps.contracts[:j], chunkGaps.contracts[j+1:]...)
 						break
 					}
 				}
+				for j := 0; j < len(chunkGaps.pieces); j++ {
+					if chunkGaps.pieces[j] == pieceIndex {
+						chunkGaps.pieces = append(chunkGaps.pieces[:j], chunkGaps.pieces[j+1:]...)
+						break
+					}
+				}
 			}
-			chunkGaps.pieces = chunkGaps.pieces[i:]
 
-			// Update the number of gaps.
-			oldNumGaps := chunkGaps.numGaps
-			if len(chunkGaps.contracts) < len(chunkGaps.pieces) {
-				chunkGaps.numGaps = len(chunkGaps.contracts)
+			// Update the number of gaps. The chunk stays memory-resident
+			// in activeChunks only while it still has outstanding or
+			// in-flight pieces; once every piece is uploaded it is freed
+			// and dropped from the repair queue instead of being
+			// requeued.
+			if newNumGaps := chunkGaps.numGaps(); newNumGaps != oldNumGaps {
+				gapCounts[oldNumGaps]--
+				gapCounts[newNumGaps]++
+			}
+			if state.done() {
+				delete(activeChunks, chosen.id)
 			} else {
-				chunkGaps.numGaps = len(chunkGaps.pieces)
+				heap.Push(repairQueue, chosen)
 			}
-			gapCounts[oldNumGaps] = gapCounts[oldNumGaps] - 1
-			gapCounts[chunkGaps.numGaps] = gapCounts[chunkGaps.numGaps] + 1
-			break
 		}
 
 		// Determine the number of workers we need in 'available'.
@@ -362,20 +407,65 @@ func (r *Renter) managedRepairIteration() {
 				return
 			}
 
+			// Report the result back to the chunk's shared state, if it is
+			// still resident: a failure frees the piece for another
+			// worker to claim, while a success marks it permanently
+			// uploaded.
+			cid := chunkID{finishedUpload.chunkIndex, finishedUpload.file.name}
+			if state, exists := activeChunks[cid]; exists {
+				oldNumGaps := state.gaps.numGaps()
+				state.pieceDone(finishedUpload.pieceIndex, finishedUpload.err)
+				if newNumGaps := state.gaps.numGaps(); newNumGaps != oldNumGaps {
+					gapCounts[oldNumGaps]--
+					gapCounts[newNumGaps]++
+				}
+				// Free a chunk as soon as its last piece is uploaded, and
+				// drop it from the repair queue.
+				if state.done() {
+					delete(activeChunks, cid)
+					for _, qe := range *repairQueue {
+						if qe.id == cid {
+							heap.Remove(repairQueue, qe.index)
+							break
+						}
+					}
+				}
+			}
+
 			if finishedUpload.err != nil {
 				r.log.Debugln("Error while performing upload to", finishedUpload.workerID, "::", finishedUpload.err)
+				r.workerErrors.recordFailure(finishedUpload.workerID, finishedUpload.err)
 				id := r.mu.Lock()
-				worker, exists := r.workerPool[finishedUpload.workerID]
+				_, exists := r.workerPool[finishedUpload.workerID]
 				if exists {
-					worker.recentUploadFailure = time.Now()
 					retiredWorkers = append(retiredWorkers, finishedUpload.workerID)
 					delete(activeWorkers, finishedUpload.workerID)
 					need--
 				}
 				r.mu.Unlock(id)
+				// Prune the retired contract from every queued chunk, not
+				// only from the chunks that happen to be popped later.
+				for _, qe := range *repairQueue {
+					oldNumGaps := qe.gaps.numGaps()
+					for i := range qe.gaps.contracts {
+						if qe.gaps.contracts[i] == finishedUpload.workerID {
+							qe.gaps.contracts = append(qe.gaps.contracts[:i], qe.gaps.contracts[i+1:]...)
+							break
+						}
+					}
+					if newNumGaps := qe.gaps.numGaps(); newNumGaps != oldNumGaps {
+						gapCounts[oldNumGaps]--
+						gapCounts[newNumGaps]++
+					}
+				}
+				heap.Init(repairQueue)
 				continue
 			}
 
+			// The upload succeeded, so any backoff previously recorded for
+			// this host no longer applies.
+			r.workerErrors.recordSuccess(finishedUpload.workerID)
+
 			// Mark that the worker is available again.
 			availableWorkers[finishedUpload.workerID] = struct{}{}
 		}
@@ -392,7 +482,9 @@ func (r *Renter) managedRepairIteration() {
 		for !done {
 			select {
 			case file := <-r.newFiles:
-				addFileToRepairMatrix(file, activeWorkers, repairMatrix, gapCounts)
+				lenBefore := repairQueue.Len()
+				addFileToRepairMatrix(file, activeWorkers, repairQueue, gapCounts)
+				quotaPassRemaining += repairQueue.Len() - lenBefore
 			default:
 				done = true
 			}
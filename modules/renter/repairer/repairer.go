@@ -0,0 +1,180 @@
+// Package repairer provides a SegmentRepairer that reconstructs chunk data
+// by downloading surviving pieces from hosts, for use when a chunk's local
+// source file has been lost. The approach mirrors Storj's segment repairer:
+// within a single chunk, pieces are fetched from every candidate source in
+// parallel rather than one host at a time, and the number of chunks
+// reconstructed concurrently is bounded so that many in-flight
+// reconstructions cannot hold more than a fixed amount of memory at once.
+package repairer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+var (
+	// ErrNotEnoughSources is returned when fewer pieces are known to survive
+	// than the erasure coder requires to recover a chunk.
+	ErrNotEnoughSources = errors.New("not enough surviving pieces to reconstruct chunk")
+
+	// ErrReconstructFailed is returned when retries are exhausted before
+	// enough pieces could be downloaded to recover a chunk.
+	ErrReconstructFailed = errors.New("unable to download enough pieces to reconstruct chunk")
+)
+
+type (
+	// PieceFetcher downloads a single erasure-coded piece of a chunk from
+	// the host backing the given contract. It is implemented by the
+	// renter so that this package does not need to know about hosts,
+	// workers, or the renter's locking conventions.
+	PieceFetcher interface {
+		FetchPiece(contract types.FileContractID, chunkIndex, pieceIndex uint64) ([]byte, error)
+	}
+
+	// DeriveKeyFunc derives the per-piece encryption key used to protect a
+	// piece on disk at a host. The renter package owns the real
+	// implementation; it is threaded through here so this package does not
+	// need to duplicate the derivation scheme.
+	DeriveKeyFunc func(masterKey crypto.TwofishKey, chunkIndex, pieceIndex uint64) crypto.TwofishKey
+
+	// PieceSource identifies a piece of a chunk that is believed to still
+	// be available on a host, and the contract backing that host.
+	PieceSource struct {
+		Contract types.FileContractID
+		Piece    uint64
+	}
+
+	// SegmentRepairer reconstructs the contents of a chunk by downloading a
+	// threshold of its surviving pieces and Reed-Solomon decoding them. It
+	// fetches every candidate source in parallel and tolerates individual
+	// download failures as long as enough of the other sources succeed.
+	SegmentRepairer struct {
+		fetcher    PieceFetcher
+		deriveKey  DeriveKeyFunc
+		maxRetries int
+
+		bufferSem chan struct{} // bounds concurrent reconstructions by memory use
+
+		reconstructionsTotal uint64
+		bytesDownloaded      uint64
+	}
+)
+
+// New creates a SegmentRepairer. bufferBytes and chunkSize bound the number
+// of reconstructions that may run concurrently, so that many in-flight
+// reconstructions cannot exhaust memory: at most bufferBytes/chunkSize will
+// run at once, but never fewer than one.
+func New(fetcher PieceFetcher, deriveKey DeriveKeyFunc, maxRetries int, bufferBytes, chunkSize int64) *SegmentRepairer {
+	concurrency := 1
+	if chunkSize > 0 {
+		if c := int(bufferBytes / chunkSize); c > concurrency {
+			concurrency = c
+		}
+	}
+	return &SegmentRepairer{
+		fetcher:    fetcher,
+		deriveKey:  deriveKey,
+		maxRetries: maxRetries,
+		bufferSem:  make(chan struct{}, concurrency),
+	}
+}
+
+// pieceFetchResult is the outcome of fetching and decrypting a single
+// candidate piece, reported back to Recover over a channel.
+type pieceFetchResult struct {
+	piece uint64
+	data  []byte
+	err   error
+}
+
+// Recover reconstructs the original chunk data given the chunk's master key,
+// erasure coder, and the set of pieces known to still be available on
+// hosts. It fetches every candidate source in parallel rather than one host
+// at a time, since waiting on hosts sequentially means the slowest host in
+// the list gates the whole reconstruction even when faster hosts already
+// hold enough pieces. It stops waiting as soon as ec.MinPieces() pieces have
+// been retrieved, tolerating up to maxRetries failed sources, or
+// NumPieces()-MinPieces() of them if the repairer was created with a
+// maxRetries that is not positive.
+func (sr *SegmentRepairer) Recover(masterKey crypto.TwofishKey, chunkIndex uint64, ec modules.ErasureCoder, chunkSize uint64, sources []PieceSource) ([]byte, error) {
+	sr.bufferSem <- struct{}{}
+	defer func() { <-sr.bufferSem }()
+
+	minPieces := ec.MinPieces()
+	if len(sources) < minPieces {
+		return nil, ErrNotEnoughSources
+	}
+	maxRetries := sr.maxRetries
+	if maxRetries <= 0 {
+		maxRetries = ec.NumPieces() - minPieces
+	}
+
+	// results is buffered to hold every source's outcome so that fetch
+	// goroutines never block trying to report in, even after Recover has
+	// already gathered enough pieces and stopped reading.
+	results := make(chan pieceFetchResult, len(sources))
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		src := src
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			raw, err := sr.fetcher.FetchPiece(src.Contract, chunkIndex, src.Piece)
+			if err != nil {
+				results <- pieceFetchResult{piece: src.Piece, err: err}
+				return
+			}
+			atomic.AddUint64(&sr.bytesDownloaded, uint64(len(raw)))
+
+			key := sr.deriveKey(masterKey, chunkIndex, src.Piece)
+			decrypted, err := key.DecryptBytes(raw)
+			results <- pieceFetchResult{piece: src.Piece, data: decrypted, err: err}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pieces := make([][]byte, ec.NumPieces())
+	have := 0
+	retries := 0
+	for have < minPieces {
+		res, ok := <-results
+		if !ok {
+			// Every source has reported in and there still aren't enough
+			// pieces.
+			return nil, ErrReconstructFailed
+		}
+		if res.err != nil {
+			retries++
+			if retries > maxRetries {
+				return nil, ErrReconstructFailed
+			}
+			continue
+		}
+		pieces[res.piece] = res.data
+		have++
+	}
+
+	chunk, err := ec.Recover(pieces, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&sr.reconstructionsTotal, 1)
+	return chunk, nil
+}
+
+// Metrics returns the repairer's cumulative counters: the total number of
+// chunks reconstructed via remote download (repair_reconstructions_total),
+// and the total bytes downloaded from hosts while doing so
+// (repair_bytes_downloaded). They let operators distinguish local-source
+// repairs from remote reconstructions.
+func (sr *SegmentRepairer) Metrics() (reconstructionsTotal, bytesDownloaded uint64) {
+	return atomic.LoadUint64(&sr.reconstructionsTotal), atomic.LoadUint64(&sr.bytesDownloaded)
+}
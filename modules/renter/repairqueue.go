@@ -0,0 +1,98 @@
+package renter
+
+import (
+	"container/heap"
+	"time"
+)
+
+const (
+	// repairFileQuota is the maximum number of chunks belonging to a single
+	// file that may be assigned work during one pass over the priority
+	// queue, so that one large file cannot monopolize every worker while
+	// other files' chunks starve.
+	repairFileQuota = 4
+)
+
+type (
+	// chunkQueueEntry is a single chunk tracked by the chunkPriorityQueue:
+	// its identity, its current gaps, and when it was added to the queue.
+	// addedAt is used to break gap-count ties in favor of whichever chunk
+	// has been waiting longest, so a chunk can't starve forever behind a
+	// stream of newly-arrived, equally-degraded chunks.
+	chunkQueueEntry struct {
+		id      chunkID
+		gaps    *chunkGaps
+		addedAt time.Time
+		index   int // heap.Interface bookkeeping
+	}
+
+	// chunkPriorityQueue is a container/heap of chunks ordered so that the
+	// most-degraded chunk (highest gap count) is always popped first, with
+	// ties broken by starvation age. It replaces the flat repair matrix map
+	// that previously required an O(N) scan to find the next chunk to
+	// repair and gave no fairness guarantee between files.
+	chunkPriorityQueue []*chunkQueueEntry
+
+	// fileQuota tracks, within a single pass over the chunkPriorityQueue,
+	// how many chunks belonging to each file have already been assigned
+	// work.
+	fileQuota struct {
+		limit  int
+		issued map[string]int
+	}
+)
+
+// Len, Less, Swap, Push, and Pop implement heap.Interface.
+func (q chunkPriorityQueue) Len() int { return len(q) }
+
+func (q chunkPriorityQueue) Less(i, j int) bool {
+	gi, gj := q[i].gaps.numGaps(), q[j].gaps.numGaps()
+	if gi != gj {
+		return gi > gj
+	}
+	return q[i].addedAt.Before(q[j].addedAt)
+}
+
+func (q chunkPriorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *chunkPriorityQueue) Push(x interface{}) {
+	entry := x.(*chunkQueueEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *chunkPriorityQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*q = old[:n-1]
+	return entry
+}
+
+// push adds a chunk to the queue, stamping it with the current time so that
+// starvation age can be used as a tiebreaker.
+func (q *chunkPriorityQueue) push(id chunkID, gaps *chunkGaps) {
+	heap.Push(q, &chunkQueueEntry{id: id, gaps: gaps, addedAt: time.Now()})
+}
+
+// newFileQuota creates a fileQuota that allows at most limit chunks per
+// file per pass. A limit of 0 disables the quota.
+func newFileQuota(limit int) *fileQuota {
+	return &fileQuota{limit: limit, issued: make(map[string]int)}
+}
+
+// allow reports whether filename is still under its per-pass quota, and if
+// so records that another chunk of work has been issued to it.
+func (fq *fileQuota) allow(filename string) bool {
+	if fq.limit > 0 && fq.issued[filename] >= fq.limit {
+		return false
+	}
+	fq.issued[filename]++
+	return true
+}
@@ -0,0 +1,93 @@
+package renter
+
+import (
+	"container/heap"
+	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// TestChunkPriorityQueueOrdering verifies that the queue pops the
+// most-degraded chunk first, and breaks ties between equally-degraded
+// chunks in favor of whichever was added first.
+func TestChunkPriorityQueueOrdering(t *testing.T) {
+	q := &chunkPriorityQueue{}
+	heap.Init(q)
+
+	twoGapContracts := []types.FileContractID{{}, {}}
+	fourGapContracts := []types.FileContractID{{}, {}, {}, {}}
+	older := &chunkQueueEntry{
+		id:      chunkID{0, "older"},
+		gaps:    &chunkGaps{pieces: []uint64{0, 1}, contracts: twoGapContracts},
+		addedAt: time.Now().Add(-time.Minute),
+	}
+	newer := &chunkQueueEntry{
+		id:      chunkID{0, "newer"},
+		gaps:    &chunkGaps{pieces: []uint64{0, 1}, contracts: twoGapContracts},
+		addedAt: time.Now(),
+	}
+	mostDegraded := &chunkQueueEntry{
+		id:      chunkID{0, "mostDegraded"},
+		gaps:    &chunkGaps{pieces: []uint64{0, 1, 2, 3}, contracts: fourGapContracts},
+		addedAt: time.Now(),
+	}
+
+	heap.Push(q, newer)
+	heap.Push(q, mostDegraded)
+	heap.Push(q, older)
+
+	first := heap.Pop(q).(*chunkQueueEntry)
+	if first != mostDegraded {
+		t.Fatalf("expected the most-degraded chunk to pop first, got %q", first.id.filename)
+	}
+
+	second := heap.Pop(q).(*chunkQueueEntry)
+	if second != older {
+		t.Fatalf("expected the older of two equally-degraded chunks to pop next, got %q", second.id.filename)
+	}
+
+	third := heap.Pop(q).(*chunkQueueEntry)
+	if third != newer {
+		t.Fatalf("expected the newer chunk to pop last, got %q", third.id.filename)
+	}
+}
+
+// TestFileQuotaAllow verifies that fileQuota caps how many chunks of a
+// single file it allows before rejecting further requests, and that a
+// zero limit disables the cap.
+func TestFileQuotaAllow(t *testing.T) {
+	fq := newFileQuota(2)
+	if !fq.allow("foo.dat") {
+		t.Fatal("expected first request for a file to be allowed")
+	}
+	if !fq.allow("foo.dat") {
+		t.Fatal("expected second request for a file to be allowed")
+	}
+	if fq.allow("foo.dat") {
+		t.Fatal("expected third request for a file to exceed its quota")
+	}
+	if !fq.allow("bar.dat") {
+		t.Fatal("expected a different file to have its own quota")
+	}
+
+	unlimited := newFileQuota(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow("foo.dat") {
+			t.Fatal("expected a zero limit to disable the quota")
+		}
+	}
+}
+
+// TestChunkGapsNumGaps verifies that numGaps reports the smaller of the
+// missing-piece and missing-contract counts, since a chunk can't be
+// repaired past whichever of the two is more scarce.
+func TestChunkGapsNumGaps(t *testing.T) {
+	gaps := &chunkGaps{
+		pieces:    []uint64{0, 1, 2},
+		contracts: []types.FileContractID{{}, {}},
+	}
+	if got := gaps.numGaps(); got != 2 {
+		t.Fatalf("expected numGaps to be 2, got %d", got)
+	}
+}
@@ -0,0 +1,228 @@
+package renter
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/NebulousLabs/Sia/persist"
+)
+
+const (
+	// repairQueuePersistFilename is the name of the file, stored in the
+	// renter directory, that backs the repair queue store across restarts.
+	repairQueuePersistFilename = "repairqueue.json"
+
+	// repairQueueSaveDebounce is how long threadedPersistRepairQueue waits
+	// after being signaled before it actually writes the store to disk, so
+	// that a burst of updates - e.g. one recordAttempt call per chosen
+	// chunk during a repair iteration - collapses into a single write
+	// instead of one synchronous write per update.
+	repairQueueSaveDebounce = time.Second
+)
+
+var repairQueueMetadata = persist.Metadata{
+	Header:  "Sia Renter Repair Queue",
+	Version: "1.0",
+}
+
+type (
+	// RepairQueueEntry is the persisted state tracked for a single chunk
+	// that is below full redundancy: how degraded it is, when it was last
+	// attempted, how many times it has been attempted, and whether
+	// reconstructing it requires downloading from hosts because its local
+	// source file is gone. It is exported so that siac can render it
+	// directly.
+	RepairQueueEntry struct {
+		ChunkIndex          uint64
+		Filename            string
+		GapCount            int
+		LastAttempt         time.Time
+		AttemptCount        int
+		NeedsReconstruction bool
+	}
+
+	// persistedRepairQueue is the on-disk representation of a
+	// repairQueueStore. A slice is used instead of a map because chunkID
+	// does not have a natural string encoding for JSON object keys.
+	persistedRepairQueue struct {
+		Entries []RepairQueueEntry
+	}
+
+	// repairQueueStore is a persisted record of every chunk currently
+	// below full redundancy, so that a renter restart does not have to
+	// walk every file before it can resume repairing where it left off.
+	// Writes to disk are debounced by threadedPersistRepairQueue rather
+	// than performed synchronously, since updateFromMatrix runs under
+	// r.mu and recordAttempt is called once per chunk chosen for repair.
+	repairQueueStore struct {
+		r *Renter
+
+		entries map[chunkID]*RepairQueueEntry
+		dirty   bool
+
+		persistDir string
+		saveSignal chan struct{}
+		mu         sync.Mutex
+	}
+)
+
+// newRepairQueueStore loads the repair queue store from persistDir, or
+// creates a new empty one if no persisted store exists yet.
+func newRepairQueueStore(r *Renter, persistDir string) (*repairQueueStore, error) {
+	rqs := &repairQueueStore{
+		r:          r,
+		entries:    make(map[chunkID]*RepairQueueEntry),
+		persistDir: persistDir,
+		saveSignal: make(chan struct{}, 1),
+	}
+
+	persistPath := filepath.Join(persistDir, repairQueuePersistFilename)
+	if _, err := os.Stat(persistPath); os.IsNotExist(err) {
+		return rqs, nil
+	}
+	var persisted persistedRepairQueue
+	if err := persist.LoadJSON(repairQueueMetadata, &persisted, persistPath); err != nil {
+		return nil, err
+	}
+	for i := range persisted.Entries {
+		entry := persisted.Entries[i]
+		cid := chunkID{entry.ChunkIndex, entry.Filename}
+		rqs.entries[cid] = &entry
+	}
+	return rqs, nil
+}
+
+// save persists the repair queue store to disk.
+func (rqs *repairQueueStore) save() error {
+	persisted := persistedRepairQueue{
+		Entries: make([]RepairQueueEntry, 0, len(rqs.entries)),
+	}
+	for _, entry := range rqs.entries {
+		persisted.Entries = append(persisted.Entries, *entry)
+	}
+	return persist.SaveJSON(repairQueueMetadata, persisted, filepath.Join(rqs.persistDir, repairQueuePersistFilename))
+}
+
+// markDirty records that the store has changes that need to be persisted
+// and wakes threadedPersistRepairQueue, without blocking if a save is
+// already pending.
+func (rqs *repairQueueStore) markDirty() {
+	rqs.dirty = true
+	select {
+	case rqs.saveSignal <- struct{}{}:
+	default:
+	}
+}
+
+// managedSaveIfDirty persists the store to disk if it has changed since the
+// last save, logging rather than returning any failure since it is called
+// from the background threadedPersistRepairQueue loop rather than in
+// response to a caller who could act on the error.
+func (rqs *repairQueueStore) managedSaveIfDirty() {
+	rqs.mu.Lock()
+	if !rqs.dirty {
+		rqs.mu.Unlock()
+		return
+	}
+	rqs.dirty = false
+	err := rqs.save()
+	rqs.mu.Unlock()
+
+	if err != nil {
+		rqs.r.log.Debugln("Unable to persist repair queue:", err)
+	}
+}
+
+// threadedPersistRepairQueue waits for the store to be marked dirty and
+// then, after a short debounce, writes it to disk. Debouncing collapses a
+// burst of updates - such as one recordAttempt per chunk chosen during a
+// repair iteration - into a single write instead of one synchronous write
+// per update performed while holding r.mu or rqs.mu.
+func (rqs *repairQueueStore) threadedPersistRepairQueue() {
+	for {
+		select {
+		case <-rqs.saveSignal:
+		case <-rqs.r.tg.StopChan():
+			return
+		}
+
+		select {
+		case <-time.After(repairQueueSaveDebounce):
+		case <-rqs.r.tg.StopChan():
+			rqs.managedSaveIfDirty()
+			return
+		}
+
+		if rqs.r.tg.Add() != nil {
+			return
+		}
+		rqs.managedSaveIfDirty()
+		rqs.r.tg.Done()
+	}
+}
+
+// updateFromMatrix reconciles the store against the chunks currently in the
+// repair queue: chunks that are no longer below full redundancy are
+// dropped, and chunks that are new or whose gap count changed are added or
+// updated, preserving LastAttempt/AttemptCount/NeedsReconstruction for
+// chunks that already had an entry.
+func (rqs *repairQueueStore) updateFromMatrix(queue *chunkPriorityQueue) {
+	rqs.mu.Lock()
+	defer rqs.mu.Unlock()
+
+	current := make(map[chunkID]struct{}, queue.Len())
+	for _, qe := range *queue {
+		current[qe.id] = struct{}{}
+		gapCount := qe.gaps.numGaps()
+		entry, exists := rqs.entries[qe.id]
+		if !exists {
+			rqs.entries[qe.id] = &RepairQueueEntry{
+				ChunkIndex: qe.id.chunkIndex,
+				Filename:   qe.id.filename,
+				GapCount:   gapCount,
+			}
+			continue
+		}
+		entry.GapCount = gapCount
+	}
+	for cid := range rqs.entries {
+		if _, stillGapped := current[cid]; !stillGapped {
+			delete(rqs.entries, cid)
+		}
+	}
+	rqs.markDirty()
+}
+
+// recordAttempt notes that a repair attempt was made on cid, optionally
+// because the chunk required reconstruction from hosts rather than from a
+// local source file.
+func (rqs *repairQueueStore) recordAttempt(cid chunkID, needsReconstruction bool) {
+	rqs.mu.Lock()
+	defer rqs.mu.Unlock()
+
+	entry, exists := rqs.entries[cid]
+	if !exists {
+		entry = &RepairQueueEntry{ChunkIndex: cid.chunkIndex, Filename: cid.filename}
+		rqs.entries[cid] = entry
+	}
+	entry.LastAttempt = time.Now()
+	entry.AttemptCount++
+	entry.NeedsReconstruction = needsReconstruction
+	rqs.markDirty()
+}
+
+// RepairQueue returns the repair queue store's contents, so that siac can
+// display a live "N chunks queued, M in progress, top 10 oldest failures"
+// report to the operator.
+func (r *Renter) RepairQueue() []RepairQueueEntry {
+	r.repairQueueStore.mu.Lock()
+	defer r.repairQueueStore.mu.Unlock()
+
+	entries := make([]RepairQueueEntry, 0, len(r.repairQueueStore.entries))
+	for _, entry := range r.repairQueueStore.entries {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
@@ -0,0 +1,68 @@
+package renter
+
+import (
+	"container/heap"
+	"os"
+	"testing"
+)
+
+// TestRepairQueueStorePersistRoundTrip verifies that updateFromMatrix
+// reconciles the store against the current queue contents, that
+// recordAttempt updates an existing entry's attempt bookkeeping, and that
+// both survive an explicit save/reload cycle.
+func TestRepairQueueStorePersistRoundTrip(t *testing.T) {
+	dir, err := os.MkdirTemp("", "repairqueuestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rqs, err := newRepairQueueStore(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := &chunkPriorityQueue{}
+	heap.Init(queue)
+	queue.push(chunkID{0, "foo.dat"}, &chunkGaps{pieces: []uint64{0, 1}})
+	rqs.updateFromMatrix(queue)
+
+	cid := chunkID{0, "foo.dat"}
+	rqs.recordAttempt(cid, true)
+
+	entry, exists := rqs.entries[cid]
+	if !exists {
+		t.Fatal("expected updateFromMatrix to have added an entry for the queued chunk")
+	}
+	if entry.AttemptCount != 1 || !entry.NeedsReconstruction {
+		t.Fatalf("expected recordAttempt to update AttemptCount and NeedsReconstruction, got %+v", entry)
+	}
+
+	// Persist explicitly, since normal callers only mark the store dirty
+	// and rely on threadedPersistRepairQueue to flush it in the
+	// background.
+	if err := rqs.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := newRepairQueueStore(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedEntry, exists := reloaded.entries[cid]
+	if !exists {
+		t.Fatal("expected the entry to survive a reload")
+	}
+	if reloadedEntry.AttemptCount != 1 || !reloadedEntry.NeedsReconstruction {
+		t.Fatalf("expected reloaded entry to preserve attempt state, got %+v", reloadedEntry)
+	}
+
+	// A second updateFromMatrix with an empty queue means the chunk is no
+	// longer below full redundancy, so it should be dropped.
+	emptyQueue := &chunkPriorityQueue{}
+	heap.Init(emptyQueue)
+	rqs.updateFromMatrix(emptyQueue)
+	if _, exists := rqs.entries[cid]; exists {
+		t.Fatal("expected a chunk no longer in the repair queue to be dropped from the store")
+	}
+}
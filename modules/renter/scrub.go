@@ -0,0 +1,297 @@
+package renter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// scrubCommand is sent over a scrubWorker's command channel to control a
+// scrub pass while it is running, mirroring Garage's ScrubWorkerCommand.
+type scrubCommand int
+
+const (
+	scrubCommandStart scrubCommand = iota
+	scrubCommandPause
+	scrubCommandCancel
+)
+
+const (
+	// scrubDefaultCadence is how often a full pass over every piece is
+	// performed by default.
+	scrubDefaultCadence = 30 * 24 * time.Hour
+
+	// scrubDefaultBytesPerSecond bounds how much host bandwidth the scrub
+	// worker is allowed to consume while issuing Merkle proof challenges.
+	scrubDefaultBytesPerSecond = 4 << 20 // 4 MiB/s
+)
+
+type (
+	// ScrubProgress is the externally-visible state of the scrub worker,
+	// returned by Renter.ScrubProgress so that siac can report on an
+	// in-progress or completed scrub. PiecesVerified, PiecesCorrupt, and
+	// TimeLeft are updated live as the current pass runs; LastCompleted is
+	// only stamped once a pass finishes.
+	ScrubProgress struct {
+		LastCompleted  time.Time
+		PiecesVerified uint64
+		PiecesCorrupt  uint64
+		TimeLeft       time.Duration
+	}
+
+	// scrubWorker periodically verifies that every piece the renter
+	// believes it has stored with a host is actually still there, by
+	// issuing a small Merkle proof challenge for each one. Pieces that
+	// fail the challenge are marked Unavailable so that the repair matrix
+	// stops treating them as healthy.
+	scrubWorker struct {
+		r        *Renter
+		commands chan scrubCommand
+
+		cadence        time.Duration
+		bytesPerSecond int64
+
+		mu       sync.Mutex
+		paused   bool
+		progress ScrubProgress
+	}
+)
+
+// newScrubWorker creates a scrubWorker using the default cadence and
+// bandwidth cap.
+func newScrubWorker(r *Renter) *scrubWorker {
+	return &scrubWorker{
+		r:              r,
+		commands:       make(chan scrubCommand),
+		cadence:        scrubDefaultCadence,
+		bytesPerSecond: scrubDefaultBytesPerSecond,
+	}
+}
+
+// ScrubStart resumes or immediately begins a scrub pass.
+func (sw *scrubWorker) ScrubStart() {
+	select {
+	case sw.commands <- scrubCommandStart:
+	case <-sw.r.tg.StopChan():
+	}
+}
+
+// ScrubPause pauses the current scrub pass; progress made so far is kept and
+// the pass resumes from where it left off on the next ScrubStart.
+func (sw *scrubWorker) ScrubPause() {
+	select {
+	case sw.commands <- scrubCommandPause:
+	case <-sw.r.tg.StopChan():
+	}
+}
+
+// ScrubCancel aborts the current scrub pass and discards its progress.
+func (sw *scrubWorker) ScrubCancel() {
+	select {
+	case sw.commands <- scrubCommandCancel:
+	case <-sw.r.tg.StopChan():
+	}
+}
+
+// Progress returns the scrub worker's current progress.
+func (sw *scrubWorker) Progress() ScrubProgress {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.progress
+}
+
+// threadedScrubLoop runs full scrub passes on a cadence, honoring
+// ScrubStart/ScrubPause/ScrubCancel commands sent in the meantime.
+func (sw *scrubWorker) threadedScrubLoop() {
+	for {
+		if sw.r.tg.Add() != nil {
+			return
+		}
+		sw.managedScrubPass()
+		sw.r.tg.Done()
+
+		select {
+		case <-sw.r.tg.StopChan():
+			return
+		case cmd := <-sw.commands:
+			sw.handleCommand(cmd)
+		case <-time.After(sw.cadence):
+		}
+	}
+}
+
+// handleCommand blocks until ScrubStart is received, unless the scrub
+// worker is cancelled or the renter is shutting down. It returns the last
+// command received, so that a caller can tell a cancel from a resume.
+func (sw *scrubWorker) handleCommand(cmd scrubCommand) scrubCommand {
+	for cmd == scrubCommandPause {
+		select {
+		case cmd = <-sw.commands:
+		case <-sw.r.tg.StopChan():
+			return cmd
+		}
+	}
+	return cmd
+}
+
+// managedScrubPass walks every piece the renter has stored with hosts,
+// issuing a Merkle proof challenge for each one and marking pieces that
+// fail as Unavailable. It is rate-limited to at most bytesPerSecond of host
+// bandwidth.
+func (sw *scrubWorker) managedScrubPass() {
+	id := sw.r.mu.RLock()
+	files := make([]*file, 0, len(sw.r.files))
+	for _, f := range sw.r.files {
+		files = append(files, f)
+	}
+	sw.r.mu.RUnlock(id)
+
+	// Count the total number of pieces up front so that TimeLeft can be
+	// estimated as the pass progresses. A pass over any non-trivial piece
+	// set can run for hours under the default bandwidth cap, so callers
+	// of Progress need live numbers rather than only the summary of the
+	// previously completed pass.
+	var total int
+	for _, f := range files {
+		f.mu.Lock()
+		for _, contract := range f.contracts {
+			total += len(contract.Pieces)
+		}
+		f.mu.Unlock()
+	}
+
+	var verified, corrupt uint64
+	limiter := newRateLimiter(sw.bytesPerSecond)
+	for _, f := range files {
+		// Snapshot which (contract, piece) pairs need challenging while
+		// holding f.mu, but issue the challenges and rate-limit waits
+		// below without it held, so that a scrub pass - which can take a
+		// long time once bandwidth-limited - doesn't block repairs or
+		// uploads from touching this file for its entire duration.
+		// Indexes are recorded rather than piece pointers so that the
+		// later write-back always lands on the live slice even if it was
+		// reallocated while the lock was released.
+		f.mu.Lock()
+		type pieceRef struct {
+			contractIdx int
+			pieceIdx    int
+			contractID  types.FileContractID
+			chunk       uint64
+			piece       uint64
+		}
+		refs := make([]pieceRef, 0)
+		for ci, contract := range f.contracts {
+			for pi, piece := range contract.Pieces {
+				refs = append(refs, pieceRef{ci, pi, contract.ID, piece.Chunk, piece.Piece})
+			}
+		}
+		f.mu.Unlock()
+
+		for _, ref := range refs {
+			select {
+			case <-sw.r.tg.StopChan():
+				return
+			case cmd := <-sw.commands:
+				if sw.handleCommand(cmd) == scrubCommandCancel {
+					return
+				}
+			default:
+			}
+
+			ok, size := sw.challengePiece(ref.contractID, ref.chunk, ref.piece)
+			limiter.wait(size)
+			if ok {
+				verified++
+			} else {
+				corrupt++
+				f.mu.Lock()
+				f.contracts[ref.contractIdx].Pieces[ref.pieceIdx].Unavailable = true
+				f.mu.Unlock()
+			}
+			sw.updateProgress(verified, corrupt, total, false)
+		}
+	}
+
+	sw.updateProgress(verified, corrupt, total, true)
+}
+
+// updateProgress records how far the current scrub pass has gotten. When
+// done is false, TimeLeft is re-estimated from the pieces not yet
+// challenged and the configured bandwidth cap, so that Progress reflects an
+// in-progress pass rather than only the most recently completed one. When
+// done is true, the pass has finished: LastCompleted is stamped and
+// TimeLeft is zeroed.
+func (sw *scrubWorker) updateProgress(verified, corrupt uint64, total int, done bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.progress.PiecesVerified = verified
+	sw.progress.PiecesCorrupt = corrupt
+	if done {
+		sw.progress.LastCompleted = time.Now()
+		sw.progress.TimeLeft = 0
+		return
+	}
+
+	remaining := total - int(verified+corrupt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	sw.progress.TimeLeft = sw.remainingEstimate(remaining)
+}
+
+// remainingEstimate estimates how long it will take to challenge
+// remainingPieces more pieces at the worker's configured bandwidth cap.
+func (sw *scrubWorker) remainingEstimate(remainingPieces int) time.Duration {
+	if sw.bytesPerSecond <= 0 {
+		return 0
+	}
+	remainingBytes := int64(remainingPieces) * merkleProofChallengeSize
+	return time.Duration(remainingBytes) * time.Second / time.Duration(sw.bytesPerSecond)
+}
+
+// challengePiece issues a small Merkle proof challenge RPC to the host
+// backing contract, asking it to prove it still holds the given piece. It
+// reports whether the challenge succeeded and the number of bytes the
+// challenge consumed, for rate limiting purposes.
+func (sw *scrubWorker) challengePiece(contract types.FileContractID, chunkIndex, pieceIndex uint64) (ok bool, bytesUsed uint64) {
+	id := sw.r.mu.RLock()
+	worker, exists := sw.r.workerPool[contract]
+	sw.r.mu.RUnlock(id)
+	if !exists {
+		return false, 0
+	}
+	err := worker.merkleProofChallenge(chunkIndex, pieceIndex)
+	return err == nil, merkleProofChallengeSize
+}
+
+// merkleProofChallengeSize is the approximate number of bytes exchanged
+// while performing a single Merkle proof challenge, used to keep the scrub
+// worker's bandwidth usage under its configured cap.
+const merkleProofChallengeSize = 4096
+
+// ScrubProgress returns the current progress of the background scrub
+// worker, for display by siac.
+func (r *Renter) ScrubProgress() ScrubProgress {
+	return r.scrubWorker.Progress()
+}
+
+// rateLimiter throttles a stream of variable-sized operations to a target
+// number of bytes per second.
+type rateLimiter struct {
+	bytesPerSecond int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait sleeps for however long is needed to keep the average rate of calls
+// to wait at or below bytesPerSecond.
+func (rl *rateLimiter) wait(n uint64) {
+	if rl.bytesPerSecond <= 0 || n == 0 {
+		return
+	}
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(rl.bytesPerSecond))
+}
@@ -0,0 +1,101 @@
+package renter
+
+import "sync"
+
+// pieceStatus tracks the lifecycle of a single piece within a
+// sharedChunkState.
+type pieceStatus int
+
+const (
+	pieceOutstanding pieceStatus = iota
+	pieceInFlight
+	pieceUploaded
+)
+
+// sharedChunkState owns the decoded, encrypted pieces for a single chunk,
+// along with which piece indexes are outstanding, in flight to a worker, or
+// already uploaded. It lets many workers cooperate on uploading the same
+// chunk instead of the repair loop re-reading and re-encoding the chunk on
+// every iteration, and lets a slow upload to one host be overtaken by
+// faster uploads of the remaining pieces to others. It is modeled on
+// Syncthing's sharedPullerState.
+type sharedChunkState struct {
+	id     chunkID
+	gaps   *chunkGaps // shared with this chunk's entry in the repair queue
+	pieces [][]byte
+	status []pieceStatus
+
+	refcount int
+
+	mu sync.Mutex
+}
+
+// newSharedChunkState creates a sharedChunkState for id from its
+// already-erasure-coded, already-encrypted pieces. gaps is the same
+// *chunkGaps held by the chunk's entry in the repair queue: when a claimed
+// piece fails to upload, it is added back to gaps.pieces so the chunk is
+// reconsidered for assignment instead of silently losing track of it.
+func newSharedChunkState(id chunkID, gaps *chunkGaps, pieces [][]byte) *sharedChunkState {
+	status := make([]pieceStatus, len(pieces))
+	for i := range status {
+		status[i] = pieceUploaded
+	}
+	for _, idx := range gaps.pieces {
+		status[idx] = pieceOutstanding
+	}
+	return &sharedChunkState{
+		id:     id,
+		gaps:   gaps,
+		pieces: pieces,
+		status: status,
+	}
+}
+
+// claimNextPiece atomically reserves the next outstanding piece for
+// uploading and increments the chunk's refcount. ok is false if nothing is
+// left to claim.
+func (s *sharedChunkState) claimNextPiece() (idx uint64, data []byte, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, st := range s.status {
+		if st == pieceOutstanding {
+			s.status[i] = pieceInFlight
+			s.refcount++
+			return uint64(i), s.pieces[i], true
+		}
+	}
+	return 0, nil, false
+}
+
+// pieceDone reports that a previously-claimed piece either finished
+// uploading or failed. A failure frees the slot so that another worker can
+// retry it; success marks it permanently uploaded. Either way the chunk's
+// refcount is decremented.
+func (s *sharedChunkState) pieceDone(idx uint64, uploadErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uploadErr != nil {
+		s.status[idx] = pieceOutstanding
+		s.gaps.pieces = append(s.gaps.pieces, idx)
+	} else {
+		s.status[idx] = pieceUploaded
+	}
+	s.refcount--
+}
+
+// done reports whether every piece has finished uploading and no worker
+// still holds a claim on the chunk, meaning it can be freed from memory and
+// removed from the repair queue.
+func (s *sharedChunkState) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refcount > 0 {
+		return false
+	}
+	for _, st := range s.status {
+		if st != pieceUploaded {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package renter
+
+import (
+	"errors"
+	"testing"
+)
+
+var errUploadFailedForTest = errors.New("upload failed")
+
+// TestSharedChunkStateClaimAndDone verifies that claiming a piece marks it
+// in-flight, that a failed upload frees it for reclaiming and adds it back
+// to the shared gaps, that a successful upload marks it permanently
+// uploaded, and that done() only reports true once every piece has been
+// uploaded and no worker still holds a claim.
+func TestSharedChunkStateClaimAndDone(t *testing.T) {
+	gaps := &chunkGaps{pieces: []uint64{0, 1}}
+	pieces := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	state := newSharedChunkState(chunkID{0, "foo.dat"}, gaps, pieces)
+
+	if state.done() {
+		t.Fatal("expected a freshly created chunk with outstanding pieces to not be done")
+	}
+
+	idx, data, ok := state.claimNextPiece()
+	if !ok {
+		t.Fatal("expected an outstanding piece to be claimable")
+	}
+	if string(data) != string(pieces[idx]) {
+		t.Fatalf("expected claimed data to match piece %d, got %q", idx, data)
+	}
+
+	// The other outstanding piece can still be claimed by a second worker,
+	// but once both are in flight nothing more is claimable.
+	otherIdx, _, ok := state.claimNextPiece()
+	if !ok {
+		t.Fatal("expected the other outstanding piece to still be claimable")
+	}
+	if _, _, ok := state.claimNextPiece(); ok {
+		t.Fatal("expected no more pieces to be claimable once both outstanding pieces are in flight")
+	}
+
+	// A failed upload frees the piece for reclaiming and requeues it in
+	// the shared gaps so the repair loop reconsiders the chunk.
+	state.pieceDone(idx, errUploadFailedForTest)
+	if _, data2, ok := state.claimNextPiece(); !ok || string(data2) != string(pieces[idx]) {
+		t.Fatal("expected the failed piece to be reclaimable")
+	}
+	found := false
+	for _, p := range gaps.pieces {
+		if p == idx {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected a failed piece to be appended back to the shared gaps")
+	}
+
+	// Finish every piece successfully.
+	state.pieceDone(idx, nil)
+	if state.done() {
+		t.Fatal("expected the chunk to not be done while a piece is still in flight")
+	}
+	state.pieceDone(otherIdx, nil)
+
+	if !state.done() {
+		t.Fatal("expected the chunk to be done once every piece is uploaded and no claims remain")
+	}
+}
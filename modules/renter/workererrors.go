@@ -0,0 +1,169 @@
+package renter
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/NebulousLabs/Sia/persist"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+const (
+	// workerErrorBaseBackoff is the starting backoff duration applied after
+	// a single upload failure to a host.
+	workerErrorBaseBackoff = 10 * time.Minute
+
+	// workerErrorCapBackoff is the maximum backoff duration that a
+	// consistently failing host can accumulate.
+	workerErrorCapBackoff = 24 * time.Hour
+
+	// workerErrorPersistFilename is the name of the file, stored alongside
+	// the renter's contract set, that backs the worker error table across
+	// restarts.
+	workerErrorPersistFilename = "workererrors.json"
+)
+
+var workerErrorMetadata = persist.Metadata{
+	Header:  "Sia Renter Worker Error Table",
+	Version: "1.0",
+}
+
+type (
+	// workerErrorInfo tracks the recent upload failures for a single host,
+	// identified by the contract backing it. It mirrors Garage's
+	// BlockResyncErrorInfo: a host that keeps failing is retried
+	// increasingly rarely, but the count is reset as soon as an upload
+	// succeeds.
+	workerErrorInfo struct {
+		ErrorCount int
+		LastTry    time.Time
+		NextTry    time.Time
+		LastError  string
+	}
+
+	// workerErrorTable is a persisted, per-host record of recent upload
+	// failures. It replaces the old flat "one hour exclusion" rule with an
+	// exponential backoff that survives renter restarts.
+	workerErrorTable struct {
+		r *Renter
+
+		Entries map[types.FileContractID]*workerErrorInfo
+
+		persistDir string
+		mu         sync.Mutex
+	}
+)
+
+// newWorkerErrorTable loads the worker error table from persistDir, or
+// creates a new empty one if no persisted table exists yet.
+func newWorkerErrorTable(r *Renter, persistDir string) (*workerErrorTable, error) {
+	wet := &workerErrorTable{
+		r:          r,
+		Entries:    make(map[types.FileContractID]*workerErrorInfo),
+		persistDir: persistDir,
+	}
+	persistPath := filepath.Join(persistDir, workerErrorPersistFilename)
+	if _, err := os.Stat(persistPath); os.IsNotExist(err) {
+		return wet, nil
+	}
+	if err := persist.LoadJSON(workerErrorMetadata, wet, persistPath); err != nil {
+		return nil, err
+	}
+	if wet.Entries == nil {
+		wet.Entries = make(map[types.FileContractID]*workerErrorInfo)
+	}
+	return wet, nil
+}
+
+// save persists the worker error table to disk.
+func (wet *workerErrorTable) save() error {
+	return persist.SaveJSON(workerErrorMetadata, wet, filepath.Join(wet.persistDir, workerErrorPersistFilename))
+}
+
+// available returns true if the host backing fcid is not currently in
+// backoff.
+func (wet *workerErrorTable) available(fcid types.FileContractID) bool {
+	wet.mu.Lock()
+	defer wet.mu.Unlock()
+	info, exists := wet.Entries[fcid]
+	if !exists {
+		return true
+	}
+	return time.Now().After(info.NextTry)
+}
+
+// recordFailure increments the error count for fcid and schedules the next
+// retry using an exponential backoff with jitter: nextTry = now +
+// min(base*2^(errorCount-1), cap) + jitter, where jitter is a random
+// duration of up to a quarter of that backoff. The first failure therefore
+// backs off for between base and 1.25*base.
+func (wet *workerErrorTable) recordFailure(fcid types.FileContractID, uploadErr error) {
+	wet.mu.Lock()
+	defer wet.mu.Unlock()
+
+	info, exists := wet.Entries[fcid]
+	if !exists {
+		info = &workerErrorInfo{}
+		wet.Entries[fcid] = info
+	}
+	info.ErrorCount++
+	info.LastTry = time.Now()
+	if uploadErr != nil {
+		info.LastError = uploadErr.Error()
+	}
+
+	backoff := workerErrorBaseBackoff << uint(info.ErrorCount-1)
+	if backoff <= 0 || backoff > workerErrorCapBackoff {
+		backoff = workerErrorCapBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff) / 4))
+	info.NextTry = info.LastTry.Add(backoff + jitter)
+
+	if err := wet.save(); err != nil {
+		wet.r.log.Debugln("Unable to persist worker error table:", err)
+	}
+}
+
+// recordSuccess clears any backoff state tracked for fcid.
+func (wet *workerErrorTable) recordSuccess(fcid types.FileContractID) {
+	wet.mu.Lock()
+	defer wet.mu.Unlock()
+	if _, exists := wet.Entries[fcid]; !exists {
+		return
+	}
+	delete(wet.Entries, fcid)
+	if err := wet.save(); err != nil {
+		wet.r.log.Debugln("Unable to persist worker error table:", err)
+	}
+}
+
+// FailedHost is the externally-visible view of a single host's entry in the
+// worker error table, returned by Renter.GetFailedHosts.
+type FailedHost struct {
+	Contract   types.FileContractID
+	ErrorCount int
+	NextTry    time.Time
+	LastError  string
+}
+
+// GetFailedHosts returns the set of hosts that currently have outstanding
+// upload failures, so that operators can diagnose which hosts are causing
+// repair stalls.
+func (r *Renter) GetFailedHosts() []FailedHost {
+	r.workerErrors.mu.Lock()
+	defer r.workerErrors.mu.Unlock()
+
+	failed := make([]FailedHost, 0, len(r.workerErrors.Entries))
+	for fcid, info := range r.workerErrors.Entries {
+		failed = append(failed, FailedHost{
+			Contract:   fcid,
+			ErrorCount: info.ErrorCount,
+			NextTry:    info.NextTry,
+			LastError:  info.LastError,
+		})
+	}
+	return failed
+}
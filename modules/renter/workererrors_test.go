@@ -0,0 +1,58 @@
+package renter
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// TestWorkerErrorTablePersistRoundTrip verifies that a recorded failure
+// makes a host unavailable until its backoff expires, that persisting and
+// reloading the table preserves that state, and that recordSuccess clears
+// it.
+func TestWorkerErrorTablePersistRoundTrip(t *testing.T) {
+	dir, err := os.MkdirTemp("", "workererrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wet, err := newWorkerErrorTable(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fcid types.FileContractID
+	fcid[0] = 1
+
+	if !wet.available(fcid) {
+		t.Fatal("expected a host with no recorded failures to be available")
+	}
+
+	wet.recordFailure(fcid, errUploadFailedForTest)
+	if wet.available(fcid) {
+		t.Fatal("expected a host with a fresh failure to be in backoff")
+	}
+
+	reloaded, err := newWorkerErrorTable(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, exists := reloaded.Entries[fcid]
+	if !exists {
+		t.Fatal("expected the recorded failure to survive a reload")
+	}
+	if entry.ErrorCount != 1 {
+		t.Fatalf("expected ErrorCount to be 1 after reload, got %d", entry.ErrorCount)
+	}
+	if !entry.NextTry.After(time.Now()) {
+		t.Fatal("expected the reloaded backoff's NextTry to still be in the future")
+	}
+
+	reloaded.recordSuccess(fcid)
+	if _, exists := reloaded.Entries[fcid]; exists {
+		t.Fatal("expected recordSuccess to clear the host's entry")
+	}
+}